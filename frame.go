@@ -0,0 +1,113 @@
+// Copyright 2014 Sven Taute. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nbreader
+
+import (
+	"bufio"
+	"context"
+	"io"
+)
+
+// SplitFunc decides whether the bytes accumulated so far by a FrameReader
+// make up a complete frame. It is shaped exactly like bufio.SplitFunc, so
+// existing split functions (e.g. bufio.ScanLines) can be reused directly.
+type SplitFunc = bufio.SplitFunc
+
+// FrameReader turns an NBReader's chunk-timeout gap detection into a
+// response framer for prompt/response protocols (RS-485, AT commands,
+// Modbus, and similar), so callers get whole frames back instead of having
+// to reassemble arbitrary byte slices themselves.
+type FrameReader struct {
+	nbr           *NBReader
+	split         SplitFunc
+	minFrameBytes int
+}
+
+// FrameOption implements options that can be passed to NewFrameReader.
+type FrameOption func(f *FrameReader)
+
+// Split sets a SplitFunc that, given the bytes accumulated so far, reports
+// when a complete frame is available. When set, a frame is finalized as soon
+// as the SplitFunc recognizes one, without waiting for a ChunkTimeout gap.
+func Split(fn SplitFunc) FrameOption {
+	return func(f *FrameReader) {
+		f.split = fn
+	}
+}
+
+// MinFrameBytes sets the minimum number of bytes a frame must contain before
+// a ChunkTimeout gap is allowed to finalize it, so a lone stray byte does not
+// prematurely end a frame. The default is 1, i.e. any gap finalizes whatever
+// has been read so far.
+func MinFrameBytes(n int) FrameOption {
+	return func(f *FrameReader) {
+		f.minFrameBytes = n
+	}
+}
+
+// NewFrameReader returns a FrameReader that reads whole frames from nbr.
+// nbr's ChunkTimeout and Timeout determine, respectively, the inter-byte gap
+// that ends a frame and the overall time budget for assembling one.
+func NewFrameReader(nbr *NBReader, options ...FrameOption) *FrameReader {
+	f := &FrameReader{nbr: nbr, minFrameBytes: 1}
+	for _, option := range options {
+		option(f)
+	}
+	return f
+}
+
+// ReadFrame blocks until a complete frame is available and returns it. A
+// frame is complete when any of the following happens first: the configured
+// SplitFunc recognizes one, no additional bytes arrive for nbr's ChunkTimeout
+// once at least MinFrameBytes have been read, or nbr's overall Timeout
+// elapses. It returns io.EOF once the underlying reader is exhausted, along
+// with any final partial frame.
+func (f *FrameReader) ReadFrame() ([]byte, error) {
+	ctx := context.Background()
+	if f.nbr.forceTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, f.nbr.forceTimeout)
+		defer cancel()
+	}
+
+	var frame []byte
+	chunk := make([]byte, f.nbr.blockSize)
+	for {
+		want := chunk
+		if f.split != nil {
+			// A full chunk would make nbr.ReadContext wait for a ChunkTimeout
+			// gap before returning; asking for one byte at a time lets the
+			// SplitFunc see each byte as soon as it has arrived.
+			want = chunk[:1]
+		}
+		n, err := f.nbr.ReadContext(ctx, want)
+		if n > 0 {
+			frame = append(frame, chunk[:n]...)
+			if f.split != nil {
+				if _, token, serr := f.split(frame, false); token != nil {
+					return token, nil
+				} else if serr != nil && serr != bufio.ErrFinalToken {
+					return frame, serr
+				}
+			}
+		}
+		switch {
+		case err == io.EOF:
+			return frame, io.EOF
+		case err == context.DeadlineExceeded:
+			return frame, nil
+		case err != nil:
+			return frame, err
+		}
+		// nbr.ReadContext only returns fewer bytes than requested when
+		// something other than a full chunk buffer interrupted it - a
+		// ChunkTimeout gap, in the common case. That already is the frame
+		// boundary: no need to spend a second ChunkTimeout confirming it
+		// with another nbr.ReadContext call that would just see n == 0.
+		if n < len(want) && len(frame) >= f.minFrameBytes {
+			return frame, nil
+		}
+	}
+}
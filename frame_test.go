@@ -0,0 +1,45 @@
+// Copyright 2014 Sven Taute. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nbreader
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+// TestFrameReaderSplitsOnChunkTimeoutGap checks that FrameReader finalizes a
+// frame as soon as a ChunkTimeout gap occurs, and reports io.EOF with any
+// final partial frame once the underlying reader is exhausted.
+func TestFrameReaderSplitsOnChunkTimeoutGap(t *testing.T) {
+	pr, pw := io.Pipe()
+
+	go func() {
+		pw.Write([]byte("hello"))
+		time.Sleep(100 * time.Millisecond)
+		pw.Write([]byte("world"))
+		time.Sleep(100 * time.Millisecond)
+		pw.Close()
+	}()
+
+	nbr := NewNBReader(pr, 64, ChunkTimeout(30*time.Millisecond), Timeout(time.Second))
+	defer nbr.Close()
+	fr := NewFrameReader(nbr)
+
+	frame, err := fr.ReadFrame()
+	if err != nil || string(frame) != "hello" {
+		t.Fatalf("first ReadFrame: got (%q, %v), want (\"hello\", nil)", frame, err)
+	}
+
+	frame, err = fr.ReadFrame()
+	if err != nil || string(frame) != "world" {
+		t.Fatalf("second ReadFrame: got (%q, %v), want (\"world\", nil)", frame, err)
+	}
+
+	frame, err = fr.ReadFrame()
+	if err != io.EOF || len(frame) != 0 {
+		t.Fatalf("third ReadFrame: got (%q, %v), want (\"\", io.EOF)", frame, err)
+	}
+}
@@ -14,33 +14,91 @@
 //
 // ChunkTimeout must be smaller than Timeout.
 //
+// NBReader also implements io.Closer: Close() stops the internal reader
+// goroutine and releases the underlying reader, and any Read() call made
+// afterwards returns ErrClosed.
+//
+// MinReadRate configures a minimum throughput: Read() returns ErrSlowReader
+// if the underlying reader falls below the configured rate.
+//
+// SetReadDeadline and ReadContext let a caller bound an individual Read call
+// without constructing a new NBReader, in the style of net.Conn deadlines and
+// context cancellation respectively.
+//
+// FrameReader (see NewFrameReader) wraps an NBReader to return whole response
+// frames, for prompt/response protocols where ChunkTimeout already marks the
+// end of a response.
+//
+// MaxBufferSize and ResumeThreshold bound the internal buffer: once it grows
+// past MaxBufferSize, the internal reader goroutine pauses until Read has
+// drained it back down to ResumeThreshold.
+//
 // Example Usage:
-//     // Create a NBReader that immediately returns on Read(), whether any data has been read or not
-//     nbr := nbreader.NewNBReader(reader, 1 << 16)
 //
-//     // Create a NBReader that tries to return on Read() after no data has been read for 200ms
-//     // or when the maximum timeout of 2 seconds is hit.
-//     nbr := nbreader.NewNBReader(reader, 1 << 16, nbreader.Timeout(2000 * time.Millisecond), nbreader.ChunkTimeout(200 * time.Millisecond))
+//	// Create a NBReader that immediately returns on Read(), whether any data has been read or not
+//	nbr := nbreader.NewNBReader(reader, 1 << 16)
+//
+//	// Create a NBReader that tries to return on Read() after no data has been read for 200ms
+//	// or when the maximum timeout of 2 seconds is hit.
+//	nbr := nbreader.NewNBReader(reader, 1 << 16, nbreader.Timeout(2000 * time.Millisecond), nbreader.ChunkTimeout(200 * time.Millisecond))
 package nbreader
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"io"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 var errTimeout = errors.New("timeout")
 
+// ErrClosed is returned by Read after the NBReader has been closed.
+var ErrClosed = errors.New("nbreader: reader closed")
+
+// ErrSlowReader is returned by Read when the underlying reader delivers data
+// slower than the rate configured with MinReadRate.
+var ErrSlowReader = errors.New("nbreader: reader too slow")
+
+// ErrDeadlineExceeded is returned by Read and ReadContext once the deadline
+// set with SetReadDeadline has passed, the same way net.Conn's methods
+// return an error once their deadline passes instead of silently returning
+// no data.
+var ErrDeadlineExceeded = errors.New("nbreader: deadline exceeded")
+
 // NBReader implements a non-blocking io.Reader.
 type NBReader struct {
-	blockSize    int
-	reader       io.Reader
-	dataChan     chan []byte
-	buffer       bytes.Buffer
-	chunkTimeout time.Duration
-	forceTimeout time.Duration
-	isEOF        bool
+	blockSize       int
+	reader          io.Reader
+	dataChan        chan readResult
+	buffer          bytes.Buffer
+	chunkTimeout    time.Duration
+	forceTimeout    time.Duration
+	minReadRate     int
+	rateWindowStart time.Time
+	rateWindowBytes int
+	err             error
+	finalErr        error
+	done            chan struct{}
+	closeOnce       sync.Once
+	closeErr        error
+	closed          int32
+	deadlineMu      sync.Mutex
+	deadline        time.Time
+	maxBufferSize   int
+	resumeThreshold int
+	bufLen          int64
+	resume          chan struct{}
+}
+
+// readResult is sent over dataChan by readInput. It carries both the bytes
+// read and the error returned alongside them, so a final short read is never
+// discarded and the real underlying error reaches Read.
+type readResult struct {
+	buf []byte
+	err error
 }
 
 // Option implements options that can be passed to NewNBReader.
@@ -60,10 +118,43 @@ func Timeout(duration time.Duration) Option {
 	}
 }
 
+// MinReadRate allows to set a minimum throughput, in bytes per second, that
+// the underlying reader must sustain. The rate is tracked in a rolling
+// one-second window kept on the NBReader itself, not reset by individual
+// Read() calls, so Read() returns ErrSlowReader as soon as a one-second
+// window averages below bytesPerSecond even if ChunkTimeout causes Read() to
+// return every chunk in between. This guards long transfers against a reader
+// that stalls or drip-feeds data without failing outright.
+func MinReadRate(bytesPerSecond int) Option {
+	return func(r *NBReader) {
+		r.minReadRate = bytesPerSecond
+	}
+}
+
+// MaxBufferSize bounds the internal buffer: once it holds more than n bytes,
+// the readInput goroutine stops pulling from the underlying reader until the
+// consumer drains it back to ResumeThreshold. Without this, a producer faster
+// than the consumer grows the internal buffer without bound.
+func MaxBufferSize(n int) Option {
+	return func(r *NBReader) {
+		r.maxBufferSize = n
+	}
+}
+
+// ResumeThreshold sets the buffer level readInput resumes at after being
+// paused by MaxBufferSize. It defaults to MaxBufferSize itself, i.e. reading
+// resumes as soon as the buffer is no longer over the limit; set it lower to
+// build in some hysteresis.
+func ResumeThreshold(n int) Option {
+	return func(r *NBReader) {
+		r.resumeThreshold = n
+	}
+}
+
 // NewNBReader returns a new NBReader with the given block size.
 func NewNBReader(reader io.Reader, blockSize int, options ...Option) *NBReader {
-	dataChan := make(chan []byte)
-	r := NBReader{reader: reader, dataChan: dataChan, blockSize: blockSize}
+	dataChan := make(chan readResult)
+	r := NBReader{reader: reader, dataChan: dataChan, blockSize: blockSize, done: make(chan struct{}), resume: make(chan struct{}, 1)}
 	for _, option := range options {
 		option(&r)
 	}
@@ -71,11 +162,72 @@ func NewNBReader(reader io.Reader, blockSize int, options ...Option) *NBReader {
 	return &r
 }
 
+// Close stops the internal reader goroutine, discards any data that is
+// currently buffered or in flight, and closes the underlying reader if it
+// implements io.Closer. After Close returns, Read returns ErrClosed. Close
+// may be called concurrently with Read, and calling it more than once is a
+// no-op that returns the same error as the first call.
+func (r *NBReader) Close() error {
+	r.closeOnce.Do(func() {
+		atomic.StoreInt32(&r.closed, 1)
+		close(r.done)
+		go func() {
+			for range r.dataChan {
+			}
+		}()
+		if closer, ok := r.reader.(io.Closer); ok {
+			r.closeErr = closer.Close()
+		}
+	})
+	return r.closeErr
+}
+
+// isClosed reports whether Close has been called.
+func (r *NBReader) isClosed() bool {
+	return atomic.LoadInt32(&r.closed) != 0
+}
+
+// SetReadDeadline sets the deadline for future Read and ReadContext calls, in
+// the same style as net.Conn.SetReadDeadline. A zero value for t means Read
+// will not time out due to a deadline, though Timeout and ChunkTimeout still
+// apply. SetReadDeadline may be called concurrently with Read or ReadContext,
+// and takes effect on the next internal poll of a call already in progress.
+func (r *NBReader) SetReadDeadline(t time.Time) error {
+	if r.isClosed() {
+		return ErrClosed
+	}
+	r.deadlineMu.Lock()
+	r.deadline = t
+	r.deadlineMu.Unlock()
+	return nil
+}
+
+func (r *NBReader) getDeadline() time.Time {
+	r.deadlineMu.Lock()
+	defer r.deadlineMu.Unlock()
+	return r.deadline
+}
+
 // Read reads data into buffer. It returns the number of bytes read into buffer.
-// At EOF, err will be io.EOF. Read() might still have read data when EOF is returned for the first time.
+// At EOF, err will be io.EOF; any other error returned by the underlying
+// reader is passed through unchanged. Read() might still have read data when
+// an error is returned for the first time. Once the underlying reader has
+// ended, a later Read keeps returning that same error, the same way a later
+// call into an already-exhausted reader would.
 //
 // Note: Read() is not safe for concurrent use.
 func (r *NBReader) Read(buffer []byte) (int, error) {
+	return r.ReadContext(context.Background(), buffer)
+}
+
+// ReadContext behaves like Read, but additionally aborts as soon as ctx is
+// done, returning ctx.Err(), or the buffered data with a nil error if any has
+// been buffered by then. This makes NBReader usable as a drop-in for code
+// that already speaks context-based cancellation instead of, or in addition
+// to, the Timeout/ChunkTimeout/SetReadDeadline idiom.
+//
+// Note: ReadContext is not safe for concurrent use.
+func (r *NBReader) ReadContext(ctx context.Context, buffer []byte) (int, error) {
 	var (
 		remaining   time.Duration
 		nextTimeout time.Duration
@@ -83,13 +235,16 @@ func (r *NBReader) Read(buffer []byte) (int, error) {
 		lastStart   = time.Now()
 	)
 
+	if r.isClosed() {
+		return 0, ErrClosed
+	}
+
 	if len(buffer) <= r.buffer.Len() {
-		ret, _ := r.buffer.Read(buffer)
-		return ret, nil
+		return r.readBuffered(buffer), nil
 	}
 
-	if r.isEOF {
-		return r.buffer.Read(buffer)
+	if r.err != nil {
+		return r.drain(buffer)
 	}
 
 	for r.buffer.Len() < len(buffer) {
@@ -100,48 +255,203 @@ func (r *NBReader) Read(buffer []byte) (int, error) {
 		} else {
 			nextTimeout = r.chunkTimeout
 		}
-		_, err := r.readWithTimeout(r.buffer, nextTimeout)
+		deadline := r.getDeadline()
+		if !deadline.IsZero() {
+			if untilDeadline := time.Until(deadline); untilDeadline < nextTimeout {
+				nextTimeout = untilDeadline
+			}
+		}
+		n, err := r.readWithTimeout(ctx, r.buffer, nextTimeout)
 		duration := time.Now().Sub(lastStart)
+		if err == ErrClosed {
+			return 0, ErrClosed
+		}
+		if err == ctx.Err() && err != nil {
+			ret := r.readBuffered(buffer)
+			if ret == 0 {
+				return 0, err
+			}
+			return ret, nil
+		}
+		if err != nil && err != errTimeout {
+			r.err = err
+			break
+		}
+		// Only a plain chunk of data or a chunk-timeout gap reaches here; a
+		// Close or other error racing the read must not be misreported as
+		// ErrSlowReader just because the rate window happened to expire on
+		// the same poll.
+		if r.minReadRate > 0 {
+			if slow, ret := r.checkReadRate(n, buffer); slow {
+				return ret, ErrSlowReader
+			}
+		}
+		// A deadline must win over the chunk-timeout break below: with
+		// ChunkTimeout shorter than the time left on the deadline, every
+		// poll would otherwise look like an ordinary chunk-timeout gap and
+		// the deadline itself would never be observed.
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			ret := r.readBuffered(buffer)
+			if ret == 0 {
+				return 0, ErrDeadlineExceeded
+			}
+			return ret, nil
+		}
 		if err == errTimeout {
 			if duration >= r.chunkTimeout {
 				break
 			}
 		}
-		if err == io.EOF {
-			r.isEOF = true
-			break
-		}
 		if time.Now().Sub(start) >= r.forceTimeout {
 			break
 		}
 	}
-	ret, _ := r.buffer.Read(buffer)
-	return ret, nil
+	if r.err != nil {
+		return r.drain(buffer)
+	}
+	return r.readBuffered(buffer), nil
+}
+
+// checkReadRate folds n freshly-delivered bytes into the rolling one-second
+// rate window and, once a full window has elapsed, reports whether the
+// average rate over that window fell below MinReadRate. The window lives on
+// r rather than on the stack, so it accumulates across chunks and across
+// separate Read()/ReadContext() calls instead of being reset every call.
+func (r *NBReader) checkReadRate(n int, buffer []byte) (bool, int) {
+	now := time.Now()
+	if r.rateWindowStart.IsZero() {
+		r.rateWindowStart = now
+	}
+	r.rateWindowBytes += n
+	elapsed := now.Sub(r.rateWindowStart)
+	if elapsed < time.Second {
+		return false, 0
+	}
+	rate := float64(r.rateWindowBytes) / elapsed.Seconds()
+	r.rateWindowStart = now
+	r.rateWindowBytes = 0
+	if rate < float64(r.minReadRate) {
+		return true, r.readBuffered(buffer)
+	}
+	return false, 0
+}
+
+// drain returns whatever is left in the buffer, reporting r.err once the
+// buffer has run dry and then clearing it. A later Read reports the same
+// error again, as readWithTimeout replays it from finalErr.
+func (r *NBReader) drain(buffer []byte) (int, error) {
+	ret := r.readBuffered(buffer)
+	if ret > 0 {
+		return ret, nil
+	}
+	err := r.err
+	r.err = nil
+	return 0, err
+}
+
+// readBuffered reads from the internal buffer into p, tracks how many bytes
+// remain in it and, once MaxBufferSize is in effect, wakes readInput up if
+// the buffer has drained far enough for it to resume. It also releases the
+// buffer's backing array once it has been fully drained, so a large burst
+// does not keep its memory allocated forever.
+func (r *NBReader) readBuffered(p []byte) int {
+	n, _ := r.buffer.Read(p)
+	if n == 0 {
+		return 0
+	}
+	atomic.AddInt64(&r.bufLen, -int64(n))
+	if r.buffer.Len() == 0 && r.buffer.Cap() > r.blockSize {
+		r.buffer = bytes.Buffer{}
+	}
+	if r.maxBufferSize > 0 {
+		r.maybeResume()
+	}
+	return n
+}
+
+// maybeResume signals readInput to resume pulling from the underlying reader
+// once the buffer has drained down to ResumeThreshold.
+func (r *NBReader) maybeResume() {
+	threshold := r.resumeThreshold
+	if threshold <= 0 {
+		threshold = r.maxBufferSize
+	}
+	if atomic.LoadInt64(&r.bufLen) > int64(threshold) {
+		return
+	}
+	select {
+	case r.resume <- struct{}{}:
+	default:
+	}
 }
 
 // readInput is used by a goroutine to read data from the underlying io.Reader
 func (r *NBReader) readInput() {
 	for {
+		if r.maxBufferSize > 0 && !r.waitForBufferRoom() {
+			close(r.dataChan)
+			return
+		}
 		tmp := make([]byte, r.blockSize)
 		length, err := r.reader.Read(tmp)
+		if length > 0 || err != nil {
+			select {
+			case r.dataChan <- readResult{buf: tmp[0:length], err: err}:
+			case <-r.done:
+				close(r.dataChan)
+				return
+			}
+		}
 		if err != nil {
 			break
 		}
-		r.dataChan <- tmp[0:length]
 	}
 	close(r.dataChan)
 }
 
+// waitForBufferRoom blocks readInput while the buffer holds more than
+// MaxBufferSize bytes, until the consumer drains it to ResumeThreshold or the
+// reader is closed. It reports whether it returned because of the latter.
+func (r *NBReader) waitForBufferRoom() bool {
+	for atomic.LoadInt64(&r.bufLen) > int64(r.maxBufferSize) {
+		select {
+		case <-r.resume:
+		case <-r.done:
+			return false
+		}
+	}
+	return true
+}
+
 // readWithTimeout consumes the data channel filled by readInput() and respects the set timeouts
-func (r *NBReader) readWithTimeout(buffer bytes.Buffer, timeout time.Duration) (int, error) {
+func (r *NBReader) readWithTimeout(ctx context.Context, buffer bytes.Buffer, timeout time.Duration) (int, error) {
 	select {
-	case data, ok := <-r.dataChan:
-		r.buffer.Write(data)
+	case res, ok := <-r.dataChan:
 		if !ok {
-			return len(data), io.EOF
+			// dataChan is closed either by Close or after readInput has
+			// delivered the error that ended it, which was remembered in
+			// finalErr below; replay that instead of manufacturing a fresh
+			// io.EOF, or every Read() after a non-EOF error would misreport
+			// the stream as having ended cleanly.
+			if r.isClosed() {
+				return 0, ErrClosed
+			}
+			if r.finalErr != nil {
+				return 0, r.finalErr
+			}
+			return 0, io.EOF
+		}
+		if res.err != nil {
+			r.finalErr = res.err
 		}
-		return len(data), nil
+		r.buffer.Write(res.buf)
+		atomic.AddInt64(&r.bufLen, int64(len(res.buf)))
+		return len(res.buf), res.err
 	case <-time.After(timeout):
 		return 0, errTimeout
+	case <-r.done:
+		return 0, ErrClosed
+	case <-ctx.Done():
+		return 0, ctx.Err()
 	}
 }
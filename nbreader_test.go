@@ -0,0 +1,190 @@
+// Copyright 2014 Sven Taute. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nbreader
+
+import (
+	"errors"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestMinReadRateAcrossChunks exercises the scenario that originally broke
+// MinReadRate: a drip-feed reader whose delivery interval is longer than
+// ChunkTimeout, so every Read() call is cut short by a chunk-timeout gap
+// long before a single call could accumulate a full one-second window on
+// its own. MinReadRate must still catch this across calls.
+func TestMinReadRateAcrossChunks(t *testing.T) {
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	go func() {
+		for i := 0; i < 30; i++ {
+			if _, err := pw.Write([]byte{'x'}); err != nil {
+				return
+			}
+			time.Sleep(150 * time.Millisecond)
+		}
+	}()
+
+	nbr := NewNBReader(pr, 64,
+		ChunkTimeout(20*time.Millisecond),
+		Timeout(10*time.Second),
+		MinReadRate(100),
+	)
+	defer nbr.Close()
+
+	buf := make([]byte, 64)
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		_, err := nbr.Read(buf)
+		if err == ErrSlowReader {
+			return
+		}
+		if err != nil {
+			t.Fatalf("Read: unexpected error %v", err)
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("ErrSlowReader was never returned for a sustained slow reader")
+		}
+	}
+}
+
+// TestCloseDiscardsBufferedData checks that once Close has been called, Read
+// returns ErrClosed immediately rather than handing out data that was
+// already sitting in the internal buffer, matching Close's doc comment.
+func TestCloseDiscardsBufferedData(t *testing.T) {
+	pr, pw := io.Pipe()
+	defer pw.Close()
+
+	nbr := NewNBReader(pr, 64, Timeout(time.Second))
+	if _, err := pw.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	// Read only part of the write, so the rest of it is left sitting in the
+	// internal buffer when Close is called.
+	if n, err := nbr.Read(make([]byte, 2)); n != 2 || err != nil {
+		t.Fatalf("partial Read: got (%d, %v), want (2, nil)", n, err)
+	}
+
+	if err := nbr.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	buf := make([]byte, 64)
+	n, err := nbr.Read(buf)
+	if err != ErrClosed {
+		t.Fatalf("Read after Close: got (%d, %v), want (0, ErrClosed)", n, err)
+	}
+	if n != 0 {
+		t.Fatalf("Read after Close returned %d buffered bytes instead of discarding them", n)
+	}
+
+	// A second Close must be a harmless no-op.
+	if err := nbr.Close(); err != nil {
+		t.Fatalf("second Close: %v", err)
+	}
+}
+
+var errBoom = errors.New("boom")
+
+// errReader always fails with a non-EOF error.
+type errReader struct{}
+
+func (errReader) Read(p []byte) (int, error) {
+	return 0, errBoom
+}
+
+// TestReadKeepsReportingNonEOFError checks that once a non-EOF error from
+// the underlying reader has been reported, later Read calls keep returning
+// that same error instead of a manufactured io.EOF once dataChan is closed.
+func TestReadKeepsReportingNonEOFError(t *testing.T) {
+	nbr := NewNBReader(errReader{}, 64, Timeout(time.Second))
+	defer nbr.Close()
+
+	buf := make([]byte, 64)
+	for i := 0; i < 3; i++ {
+		_, err := nbr.Read(buf)
+		if err != errBoom {
+			t.Fatalf("Read #%d: got %v, want %v", i, err, errBoom)
+		}
+	}
+}
+
+// TestSetReadDeadlineReturnsErrDeadlineExceeded checks that a deadline that
+// actually passes is reported as ErrDeadlineExceeded, not swallowed into a
+// plain (0, nil) once the internal chunk-timeout loop has nothing else to
+// report.
+func TestSetReadDeadlineReturnsErrDeadlineExceeded(t *testing.T) {
+	pr, pw := io.Pipe()
+	defer pw.Close()
+
+	nbr := NewNBReader(pr, 64, Timeout(5*time.Second))
+	defer nbr.Close()
+
+	if err := nbr.SetReadDeadline(time.Now().Add(50 * time.Millisecond)); err != nil {
+		t.Fatalf("SetReadDeadline: %v", err)
+	}
+
+	buf := make([]byte, 64)
+	start := time.Now()
+	n, err := nbr.Read(buf)
+	elapsed := time.Since(start)
+
+	if err != ErrDeadlineExceeded {
+		t.Fatalf("Read: got (%d, %v), want (0, ErrDeadlineExceeded)", n, err)
+	}
+	if elapsed > time.Second {
+		t.Fatalf("Read did not return promptly after the deadline: took %v", elapsed)
+	}
+}
+
+// infiniteReader produces an endless stream of data without ever blocking,
+// so MaxBufferSize's backpressure is the only thing that can bound how much
+// of it ends up buffered.
+type infiniteReader struct{}
+
+func (infiniteReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 'x'
+	}
+	return len(p), nil
+}
+
+// TestMaxBufferSizeBoundsGrowth checks that MaxBufferSize actually stops
+// readInput from outrunning the consumer: without it, a reader this fast
+// would fill a 1MB request long before Timeout elapses.
+func TestMaxBufferSizeBoundsGrowth(t *testing.T) {
+	nbr := NewNBReader(infiniteReader{}, 16,
+		Timeout(150*time.Millisecond),
+		MaxBufferSize(64),
+		ResumeThreshold(32),
+	)
+	defer nbr.Close()
+
+	const maxAllowed = 64 + 16 + 256 // high watermark + one in-flight block + scheduling slack
+
+	buf := make([]byte, 1<<20)
+	n, err := nbr.Read(buf)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if n > maxAllowed {
+		t.Fatalf("MaxBufferSize did not bound buffer growth: read %d bytes, want at most %d", n, maxAllowed)
+	}
+	if bl := atomic.LoadInt64(&nbr.bufLen); bl > maxAllowed {
+		t.Fatalf("internal buffer grew past MaxBufferSize: %d bytes buffered", bl)
+	}
+
+	// Having drained well below ResumeThreshold, readInput must resume
+	// filling the buffer rather than staying paused forever.
+	n2, err := nbr.Read(buf)
+	if err != nil {
+		t.Fatalf("second Read: %v", err)
+	}
+	if n2 == 0 {
+		t.Fatal("readInput did not resume after the buffer drained past ResumeThreshold")
+	}
+}